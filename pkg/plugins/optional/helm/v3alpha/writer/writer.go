@@ -17,21 +17,66 @@ limitations under the License.
 package writer
 
 import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"errors"
 	"fmt"
+	"net/http"
 	"os"
+	"path"
 	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/spf13/afero"
 	"sigs.k8s.io/kubebuilder/v4/pkg/machinery"
 )
 
+// Backend names accepted by NewChartWriter.
+const (
+	BackendOS       = "os"
+	BackendMem      = "mem"
+	BackendBasePath = "basepath"
+	BackendReadOnly = "readonly"
+	BackendHTTP     = "http"
+)
+
 type IfExistsAction string
 
 const (
 	Override IfExistsAction = "Override"
 	Skip     IfExistsAction = "Skip"
+
+	// Merge performs a three-way merge between the file as it was last
+	// generated, the file as it currently sits on disk (which may carry user
+	// edits), and the newly generated content. It only works on a ChartWriter
+	// created by NewOverlayWriter, which records the "last generated" side;
+	// on a plain ChartWriter it behaves like Override.
+	Merge IfExistsAction = "Merge"
 )
 
+// MergeConflictError reports chart files where the user's on-disk edits and
+// the newly generated content both diverged from the last generated
+// version, so WriteFiles could not merge them safely and left the existing
+// file untouched.
+type MergeConflictError struct {
+	Paths []string
+}
+
+func (e *MergeConflictError) Error() string {
+	return fmt.Sprintf("merge conflicts in %d file(s), left unchanged: %s", len(e.Paths), strings.Join(e.Paths, ", "))
+}
+
+// archiveModTime is stamped on every entry written by WriteArchive and
+// PackageChart instead of the real mtime, so two runs over identical chart
+// content produce byte-identical archives.
+var archiveModTime = time.Unix(0, 0)
+
 type ChartFile struct {
 	// Path is the relative path to the chart directory
 	Path string
@@ -47,44 +92,602 @@ type ChartFile struct {
 type ChartWriter struct {
 	Directory  string
 	FileSystem machinery.Filesystem
+
+	// base holds a snapshot of each file's content as it was last
+	// generated, used by WriteFiles to tell genuine user edits apart from a
+	// file simply being regenerated unchanged. Set by NewOverlayWriter; nil
+	// for a plain ChartWriter, in which case IfExistsAction Merge behaves
+	// like Override.
+	base afero.Fs
+
+	// preRooted marks that FileSystem.FS is already confined to Directory
+	// (e.g. the "basepath" NewChartWriter backend), so helpers must not
+	// join Directory onto paths handed to it a second time. Directory
+	// itself is still kept set to the real chart directory/name in this
+	// case, purely for display and naming (archive/index names, ...).
+	preRooted bool
+}
+
+// NewOverlayWriter returns a ChartWriter whose FileSystem layers the user's
+// existing, possibly hand-edited chart directory (writable) on top of a
+// read-only snapshot of what was last generated (base), using afero's
+// CopyOnWriteFs. This lets WriteFiles re-run against an already customized
+// chart, honouring IfExistsAction Merge instead of clobbering user changes.
+//
+// seed is the chart as it was produced by the previous run -- typically
+// whatever a caller got back from that earlier ChartWriter's SnapshotFiles,
+// persisted to a cache between invocations -- and is used to populate base.
+// Without it, Merge would have nothing to diff incoming content against but
+// an empty file and would report every customized file as conflicting, even
+// though nothing actually changed on the generated side. Pass nil seed for a
+// chart with no prior generation to diff against.
+func NewOverlayWriter(directory string, writable afero.Fs, seed []ChartFile) (ChartWriter, error) {
+	base := afero.NewMemMapFs()
+	for _, file := range seed {
+		path := filepath.Join(directory, file.Path)
+		if err := base.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			return ChartWriter{}, fmt.Errorf("failed to seed base snapshot for %s: %w", file.Path, err)
+		}
+		if err := afero.WriteFile(base, path, []byte(file.Content), 0o644); err != nil {
+			return ChartWriter{}, fmt.Errorf("failed to seed base snapshot for %s: %w", file.Path, err)
+		}
+	}
+
+	overlay := afero.NewCopyOnWriteFs(afero.NewReadOnlyFs(base), writable)
+	return ChartWriter{
+		Directory:  directory,
+		FileSystem: machinery.Filesystem{FS: overlay},
+		base:       base,
+	}, nil
+}
+
+// SnapshotFiles reads the chart as it currently sits in FileSystem.FS back
+// into ChartFiles, for a caller to persist and pass as the seed to the next
+// process's NewOverlayWriter call.
+func (c ChartWriter) SnapshotFiles() ([]ChartFile, error) {
+	return c.readChartFiles()
+}
+
+// ChartWriterOption configures a ChartWriter constructed via NewChartWriter.
+type ChartWriterOption func(*chartWriterOptions)
+
+type chartWriterOptions struct {
+	base afero.Fs
+}
+
+// WithBase sets the afero.Fs wrapped by the basepath and readonly backends.
+// Defaults to afero.NewOsFs() when unset.
+func WithBase(fs afero.Fs) ChartWriterOption {
+	return func(o *chartWriterOptions) { o.base = fs }
+}
+
+// NewChartWriter builds a ChartWriter backed by the named filesystem
+// backend: "os", "mem", "basepath" (rooted at directory), "readonly" or
+// "http" (an in-memory chart browsable/downloadable over ServeHTTP). This
+// lets callers pick a backend without reaching into afero directly.
+func NewChartWriter(directory, backend string, opts ...ChartWriterOption) (*ChartWriter, error) {
+	options := chartWriterOptions{base: afero.NewOsFs()}
+	for _, opt := range opts {
+		opt(&options)
+	}
+
+	switch backend {
+	case BackendOS:
+		return &ChartWriter{Directory: directory, FileSystem: machinery.Filesystem{FS: afero.NewOsFs()}}, nil
+	case BackendMem:
+		return &ChartWriter{Directory: directory, FileSystem: machinery.Filesystem{FS: afero.NewMemMapFs()}}, nil
+	case BackendBasePath:
+		// BasePathFs already roots every path at directory. Directory is
+		// kept set to the real chart directory (used for naming archives
+		// and the generated index); preRooted tells internal helpers not
+		// to join it onto paths a second time.
+		return &ChartWriter{
+			Directory:  directory,
+			FileSystem: machinery.Filesystem{FS: afero.NewBasePathFs(options.base, directory)},
+			preRooted:  true,
+		}, nil
+	case BackendReadOnly:
+		return &ChartWriter{Directory: directory, FileSystem: machinery.Filesystem{FS: afero.NewReadOnlyFs(options.base)}}, nil
+	case BackendHTTP:
+		return &ChartWriter{Directory: directory, FileSystem: machinery.Filesystem{FS: afero.NewMemMapFs()}}, nil
+	default:
+		return nil, fmt.Errorf("unknown chart writer backend %q", backend)
+	}
+}
+
+// ServeHTTP mounts the chart written to Directory as a Helm chart
+// repository: the chart tree packaged as a .tgz plus a generated
+// index.yaml, served over HTTP via afero.NewHttpFs so `helm repo add` and
+// `helm pull` work against it directly. The archive and index.yaml are
+// first written into Directory through FileSystem.FS, so they stay off disk
+// only with an in-memory backend such as "mem" or "http".
+func (c ChartWriter) ServeHTTP() (http.Handler, error) {
+	if err := c.writeIndex(); err != nil {
+		return nil, fmt.Errorf("failed to generate chart repository index: %w", err)
+	}
+
+	httpFS := afero.NewHttpFs(c.rootedFS())
+	return http.FileServer(httpFS.Dir(".")), nil
+}
+
+// writeIndex packages the chart and writes a minimal index.yaml next to it
+// pointing at the resulting archive, mirroring `helm repo index`.
+func (c ChartWriter) writeIndex() error {
+	chartName := filepath.Base(c.Directory)
+	archiveName := chartName + ".tgz"
+	archivePath := c.chartRelativePath(archiveName)
+
+	if err := c.PackageChart(archivePath); err != nil {
+		return err
+	}
+
+	index := fmt.Sprintf("apiVersion: v1\nentries:\n  %s:\n  - name: %s\n    urls:\n    - %s\n",
+		chartName, chartName, archiveName)
+
+	indexPath := c.chartRelativePath("index.yaml")
+	return afero.WriteFile(c.outputFS(), indexPath, []byte(index), 0o644)
+}
+
+// FileAction describes what WriteFiles did (or, in PlanFiles, would do) for
+// a single chart file.
+type FileAction string
+
+const (
+	ActionCreate    FileAction = "Create"
+	ActionOverwrite FileAction = "Overwrite"
+	ActionSkip      FileAction = "Skip"
+	ActionUnchanged FileAction = "Unchanged"
+)
+
+// FilePlan reports the FileAction WriteFiles took, or would take, for a
+// single chart file.
+type FilePlan struct {
+	Path   string
+	Action FileAction
+}
+
+// rootedFS returns the afero.Fs to use for every read, write and stat of a
+// chart-relative path. If FileSystem.FS is already confined to Directory
+// (preRooted), it's returned as-is; otherwise it's wrapped in an
+// afero.BasePathFs rooted at Directory so those operations can't be pointed
+// outside it via an absolute path or a ".." segment. BasePathFs only does a
+// lexical prefix check on the cleaned path, so it does NOT by itself stop a
+// symlink inside the chart directory from resolving outside it on the
+// underlying OS -- see symlinkEscapes for that check.
+func (c ChartWriter) rootedFS() afero.Fs {
+	if c.preRooted {
+		return c.FileSystem.FS
+	}
+	return afero.NewBasePathFs(c.FileSystem.FS, c.Directory)
+}
+
+// outputFS returns the afero.Fs that archive/index paths outside the
+// per-file rooting above (WriteArchive, PackageChart, writeIndex) should be
+// written through: the plain FileSystem.FS when it isn't already rooted at
+// Directory, or rootedFS() when it is, since there is then no path outside
+// Directory left to address.
+func (c ChartWriter) outputFS() afero.Fs {
+	if c.preRooted {
+		return c.rootedFS()
+	}
+	return c.FileSystem.FS
+}
+
+// chartRelativePath returns the path to use against outputFS() for a name
+// that lives inside the chart directory: joined with Directory when
+// FileSystem.FS isn't already rooted there, or left bare otherwise.
+func (c ChartWriter) chartRelativePath(name string) string {
+	if c.preRooted {
+		return name
+	}
+	return filepath.Join(c.Directory, name)
+}
+
+// validateChartPath rejects a ChartFile.Path that, once cleaned, is
+// absolute or escapes the chart directory via a ".." segment -- the case
+// that let a malicious template write outside Directory when Path was
+// joined onto it without checking.
+func validateChartPath(p string) error {
+	if filepath.IsAbs(p) {
+		return fmt.Errorf("chart file path %q must be relative", p)
+	}
+	clean := filepath.Clean(p)
+	if clean == ".." || strings.HasPrefix(clean, ".."+string(filepath.Separator)) {
+		return fmt.Errorf("chart file path %q escapes the chart directory", p)
+	}
+	return nil
+}
+
+// symlinkEscapes reports whether path, once joined onto Directory, resolves
+// through a symlink to somewhere outside Directory on the real OS
+// filesystem. BasePathFs' prefix check can't catch this, since it never
+// dereferences symlinks. The file itself is usually about to be created and
+// so won't exist yet, which would make filepath.EvalSymlinks on the full
+// path fail outright -- to still catch a symlinked parent directory in that
+// case, only the longest existing prefix of path is resolved, and the
+// not-yet-created remainder is joined back on afterwards; Directory itself
+// is resolved the same way. This is a best-effort check made against the
+// real OS filesystem whatever backs FileSystem.FS: a chart whose Directory
+// and ancestors hold no symlink leading outside it (such as an in-memory
+// chart whose Directory does not exist on disk) reports no escape, and an
+// OS error other than not-exist while resolving is not reported as one.
+func (c ChartWriter) symlinkEscapes(path string) (bool, error) {
+	if c.Directory == "" {
+		return false, nil
+	}
+
+	full := filepath.Join(c.Directory, path)
+	resolvedPrefix, remainder, err := resolveExistingPrefix(full)
+	if err != nil {
+		// Resolving failed for a reason other than a missing path component
+		// (e.g. permission denied); this is not reported as an escape.
+		return false, nil
+	}
+	resolved := filepath.Join(resolvedPrefix, remainder)
+
+	root := c.Directory
+	if rootPrefix, rootRemainder, err := resolveExistingPrefix(c.Directory); err == nil {
+		root = filepath.Join(rootPrefix, rootRemainder)
+	}
+
+	rel, err := filepath.Rel(root, resolved)
+	if err != nil {
+		return true, nil
+	}
+	return rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)), nil
+}
+
+// resolveExistingPrefix walks up from full until it finds the longest path
+// prefix that actually exists on disk, evaluates any symlinks in that
+// prefix, and returns the resolved prefix together with the remaining,
+// not-yet-created path components beneath it.
+func resolveExistingPrefix(full string) (resolvedPrefix, remainder string, err error) {
+	dir := full
+	var tail []string
+	for {
+		resolved, statErr := filepath.EvalSymlinks(dir)
+		if statErr == nil {
+			return resolved, filepath.Join(tail...), nil
+		}
+		if !os.IsNotExist(statErr) {
+			return "", "", statErr
+		}
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return "", "", statErr
+		}
+		tail = append([]string{filepath.Base(dir)}, tail...)
+		dir = parent
+	}
 }
 
 // WriteFile persists one file on the disk
 func (c ChartWriter) WriteFile(file ChartFile) error {
+	_, err := c.writeFile(file, false)
+	return err
+}
+
+func (c ChartWriter) writeFile(file ChartFile, dryRun bool) (FileAction, error) {
+	if err := validateChartPath(file.Path); err != nil {
+		return "", err
+	}
+	if escapes, err := c.symlinkEscapes(file.Path); err != nil {
+		return "", err
+	} else if escapes {
+		return "", fmt.Errorf("chart file path %q resolves through a symlink outside the chart directory", file.Path)
+	}
+
 	content := c.updateEOF(file.Content)
-	path := filepath.Join(c.Directory, file.Path)
+	generated := content
+	fs := c.rootedFS()
+	path := filepath.Clean(file.Path)
 
-	// Check if the file already exists and should be skipped
-	if _, err := os.Stat(path); !os.IsNotExist(err) && file.IfExistsAction == Skip {
-		return nil
+	exists, err := afero.Exists(fs, path)
+	if err != nil {
+		return "", fmt.Errorf("failed to stat file %s: %w", path, err)
+	}
+
+	if exists {
+		switch file.IfExistsAction {
+		case Skip:
+			return ActionSkip, nil
+		case Merge:
+			if c.base != nil {
+				merged, conflict, err := c.mergeFile(fs, path, content)
+				if err != nil {
+					return "", err
+				}
+				if conflict {
+					return ActionSkip, &MergeConflictError{Paths: []string{file.Path}}
+				}
+				content = merged
+			}
+		}
+
+		// Skip the rewrite when the content hasn't actually changed, so we
+		// don't churn mtimes and bust Helm's chart digest cache or container
+		// image layer reuse for a no-op write.
+		unchanged, err := c.unchanged(fs, path, content)
+		if err != nil {
+			return "", err
+		}
+		if unchanged {
+			if c.base != nil && !dryRun {
+				basePath := filepath.Join(c.Directory, path)
+				if err := afero.WriteFile(c.base, basePath, []byte(generated), 0o644); err != nil {
+					return "", fmt.Errorf("failed to snapshot generated file %s: %w", path, err)
+				}
+			}
+			return ActionUnchanged, nil
+		}
+	}
+
+	action := ActionCreate
+	if exists {
+		action = ActionOverwrite
+	}
+	if dryRun {
+		return action, nil
 	}
 
 	// Create directory if it doesn't exist
 	dir := filepath.Dir(path)
-	if err := c.FileSystem.FS.MkdirAll(dir, 0o755); err != nil {
-		return fmt.Errorf("failed to create directory %s: %w", dir, err)
+	if err := fs.MkdirAll(dir, 0o755); err != nil {
+		return "", fmt.Errorf("failed to create directory %s: %w", dir, err)
 	}
 
 	// Use afero to write directly through the filesystem
-	if err := afero.WriteFile(c.FileSystem.FS, path, []byte(content), 0o644); err != nil {
-		return fmt.Errorf("failed to write file %s: %w", path, err)
+	if err := afero.WriteFile(fs, path, []byte(content), 0o644); err != nil {
+		return "", fmt.Errorf("failed to write file %s: %w", path, err)
 	}
 
-	return nil
+	if c.base != nil {
+		basePath := filepath.Join(c.Directory, path)
+		if err := afero.WriteFile(c.base, basePath, []byte(generated), 0o644); err != nil {
+			return "", fmt.Errorf("failed to snapshot generated file %s: %w", path, err)
+		}
+	}
+
+	return action, nil
+}
+
+// unchanged reports whether the file already at path has the same SHA256
+// digest as content.
+func (c ChartWriter) unchanged(fs afero.Fs, path, content string) (bool, error) {
+	existing, err := afero.ReadFile(fs, path)
+	if err != nil {
+		return false, fmt.Errorf("failed to read file %s: %w", path, err)
+	}
+	return sha256.Sum256(existing) == sha256.Sum256([]byte(content)), nil
+}
+
+// mergeFile performs the three-way merge backing IfExistsAction Merge: base
+// is the content last generated (from c.base), current is whatever sits on
+// disk now, and generated is the newly rendered content.
+func (c ChartWriter) mergeFile(fs afero.Fs, path, generated string) (merged string, conflict bool, err error) {
+	current, err := afero.ReadFile(fs, path)
+	if err != nil {
+		return "", false, fmt.Errorf("failed to read existing file %s: %w", path, err)
+	}
+
+	base, _ := afero.ReadFile(c.base, filepath.Join(c.Directory, path))
+
+	merged, conflict = mergeLines(string(base), string(current), generated)
+	return merged, conflict, nil
+}
+
+// mergeLines performs a simple line-based three-way merge: a line left
+// unchanged from base takes whichever side changed it, a line changed the
+// same way on both sides is kept, and a line changed differently on both
+// sides at the same position is reported as a conflict.
+func mergeLines(base, current, generated string) (merged string, conflict bool) {
+	baseLines := strings.Split(base, "\n")
+	curLines := strings.Split(current, "\n")
+	genLines := strings.Split(generated, "\n")
+
+	max := len(baseLines)
+	if len(curLines) > max {
+		max = len(curLines)
+	}
+	if len(genLines) > max {
+		max = len(genLines)
+	}
+
+	out := make([]string, 0, max)
+	for i := 0; i < max; i++ {
+		b, cur, gen := lineAt(baseLines, i), lineAt(curLines, i), lineAt(genLines, i)
+		switch {
+		case cur == gen:
+			out = append(out, cur)
+		case cur == b:
+			out = append(out, gen)
+		case gen == b:
+			out = append(out, cur)
+		default:
+			conflict = true
+		}
+	}
+	if conflict {
+		return "", true
+	}
+	return strings.Join(out, "\n"), false
+}
+
+func lineAt(lines []string, i int) string {
+	if i < len(lines) {
+		return lines[i]
+	}
+	return ""
 }
 
-// WriteFiles persists the files on the disk
+// WriteFiles persists the files on the disk. Files are sorted by path and
+// handed out in that order to a worker pool bounded by GOMAXPROCS; with more
+// than one worker the writes run concurrently, so the order in which files
+// land on disk is not fixed. Per-file failures are aggregated with errors.Join
+// so callers can errors.Is/errors.As on an individual failure.
 func (c ChartWriter) WriteFiles(files []ChartFile) error {
-	var errors []error
-	for _, file := range files {
-		err := c.WriteFile(file)
+	_, err := c.writeFiles(files, false)
+	return err
+}
+
+// PlanFiles reports, without writing anything, the FileAction WriteFiles
+// would take for each file, in path-sorted order, so a caller can preview a
+// regeneration before committing to it.
+func (c ChartWriter) PlanFiles(files []ChartFile) ([]FilePlan, error) {
+	return c.writeFiles(files, true)
+}
+
+func (c ChartWriter) writeFiles(files []ChartFile, dryRun bool) ([]FilePlan, error) {
+	sorted := make([]ChartFile, len(files))
+	copy(sorted, files)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].Path < sorted[j].Path })
+
+	workers := runtime.GOMAXPROCS(0)
+	if workers > len(sorted) {
+		workers = len(sorted)
+	}
+	if workers < 1 {
+		workers = 1
+	}
+
+	plans := make([]FilePlan, len(sorted))
+	errs := make([]error, len(sorted))
+
+	jobs := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				action, err := c.writeFile(sorted[i], dryRun)
+				plans[i] = FilePlan{Path: sorted[i].Path, Action: action}
+				if err != nil {
+					errs[i] = fmt.Errorf("unable to write file %s: %w", sorted[i].Path, err)
+				}
+			}
+		}()
+	}
+	for i := range sorted {
+		jobs <- i
+	}
+	close(jobs)
+	wg.Wait()
+
+	var joined []error
+	var conflicts []string
+	for _, err := range errs {
+		if err == nil {
+			continue
+		}
+		var mergeErr *MergeConflictError
+		if errors.As(err, &mergeErr) {
+			conflicts = append(conflicts, mergeErr.Paths...)
+			continue
+		}
+		joined = append(joined, err)
+	}
+	if len(conflicts) > 0 {
+		joined = append(joined, &MergeConflictError{Paths: conflicts})
+	}
+
+	return plans, errors.Join(joined...)
+}
+
+// WriteArchive packages files directly into a gzip-compressed tar archive,
+// laid out the way `helm package` expects: a single top-level directory
+// named after the chart (the base name of Directory) containing the given
+// files. The archive is written as a sibling of Directory (<Directory>.tgz),
+// or -- when FileSystem.FS is already confined to Directory -- inside it,
+// named after the chart. It lets callers emit a distributable chart archive
+// without first writing loose files to disk.
+func (c ChartWriter) WriteArchive(files []ChartFile) error {
+	if c.preRooted {
+		// There's no path outside Directory left to address once
+		// FileSystem.FS is already confined to it, so the archive lands
+		// inside Directory itself instead of as its sibling.
+		return c.writeArchive(c.rootedFS(), filepath.Base(c.Directory)+".tgz", files)
+	}
+	return c.writeArchive(c.FileSystem.FS, c.Directory+".tgz", files)
+}
+
+// PackageChart packages the chart previously written to Directory (e.g. via
+// WriteFiles) into a .tgz at outputPath.
+func (c ChartWriter) PackageChart(outputPath string) error {
+	files, err := c.readChartFiles()
+	if err != nil {
+		return fmt.Errorf("failed to read chart directory %s: %w", c.Directory, err)
+	}
+	return c.writeArchive(c.outputFS(), outputPath, files)
+}
+
+// readChartFiles walks the already-materialized chart directory and loads
+// it back into ChartFiles so it can be re-packaged by PackageChart.
+func (c ChartWriter) readChartFiles() ([]ChartFile, error) {
+	fs := c.rootedFS()
+	var files []ChartFile
+	err := afero.Walk(fs, ".", func(p string, info os.FileInfo, err error) error {
 		if err != nil {
-			errors = append(errors, fmt.Errorf("unable to write file %s: %w", file.Path, err))
+			return err
+		}
+		if info.IsDir() {
+			return nil
+		}
+		content, err := afero.ReadFile(fs, p)
+		if err != nil {
+			return err
+		}
+		files = append(files, ChartFile{Path: filepath.Clean(p), Content: string(content)})
+		return nil
+	})
+	return files, err
+}
+
+// writeArchive streams files into a gzip-compressed tar archive at
+// outputPath (through fs) with deterministic ordering, mode bits and
+// modtime so repeated runs over identical content are reproducible.
+func (c ChartWriter) writeArchive(fs afero.Fs, outputPath string, files []ChartFile) error {
+	sorted := make([]ChartFile, len(files))
+	copy(sorted, files)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].Path < sorted[j].Path })
+
+	chartName := filepath.Base(c.Directory)
+
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gz)
+
+	for _, file := range sorted {
+		if err := validateChartPath(file.Path); err != nil {
+			return fmt.Errorf("refusing to archive %s: %w", file.Path, err)
+		}
+
+		content := c.updateEOF(file.Content)
+		hdr := &tar.Header{
+			Name:    path.Join(chartName, filepath.ToSlash(file.Path)),
+			Mode:    0o644,
+			Size:    int64(len(content)),
+			ModTime: archiveModTime,
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return fmt.Errorf("failed to write archive header for %s: %w", file.Path, err)
+		}
+		if _, err := tw.Write([]byte(content)); err != nil {
+			return fmt.Errorf("failed to write archive content for %s: %w", file.Path, err)
 		}
 	}
-	if len(errors) > 0 {
-		return fmt.Errorf("errors writing files: %v", errors)
+
+	if err := tw.Close(); err != nil {
+		return fmt.Errorf("failed to close chart archive: %w", err)
 	}
+	if err := gz.Close(); err != nil {
+		return fmt.Errorf("failed to close chart archive compressor: %w", err)
+	}
+
+	if err := afero.WriteFile(fs, outputPath, buf.Bytes(), 0o644); err != nil {
+		return fmt.Errorf("failed to write chart archive %s: %w", outputPath, err)
+	}
+
 	return nil
 }
 
@@ -0,0 +1,572 @@
+/*
+Copyright 2026 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package writer
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/spf13/afero"
+	"sigs.k8s.io/kubebuilder/v4/pkg/machinery"
+)
+
+func TestNewChartWriter_BasePathBackend_WriteFilesEndToEnd(t *testing.T) {
+	dir := t.TempDir()
+	chartDir := filepath.Join(dir, "mychart")
+
+	cw, err := NewChartWriter(chartDir, BackendBasePath)
+	if err != nil {
+		t.Fatalf("NewChartWriter: %v", err)
+	}
+
+	files := []ChartFile{
+		{Path: "Chart.yaml", Content: "name: mychart"},
+		{Path: "templates/deployment.yaml", Content: "kind: Deployment"},
+	}
+
+	if err := cw.WriteFiles(files); err != nil {
+		t.Fatalf("WriteFiles: %v", err)
+	}
+
+	for _, f := range files {
+		got, err := os.ReadFile(filepath.Join(chartDir, f.Path))
+		if err != nil {
+			t.Fatalf("reading %s from disk: %v", f.Path, err)
+		}
+		if string(got) != f.Content+"\n" {
+			t.Fatalf("content mismatch for %s: got %q, want %q", f.Path, got, f.Content+"\n")
+		}
+	}
+
+	// A second pass with identical content should report everything
+	// Unchanged rather than erroring or duplicating the directory nesting
+	// the original bug produced.
+	plans, err := cw.PlanFiles(files)
+	if err != nil {
+		t.Fatalf("PlanFiles: %v", err)
+	}
+	for _, p := range plans {
+		if p.Action != ActionUnchanged {
+			t.Errorf("PlanFiles(%s) = %s, want Unchanged", p.Path, p.Action)
+		}
+	}
+}
+
+func TestWriteFile_RejectsPathTraversal(t *testing.T) {
+	cw := ChartWriter{
+		Directory:  t.TempDir(),
+		FileSystem: machinery.Filesystem{FS: afero.NewMemMapFs()},
+	}
+
+	for _, path := range []string{"../outside.yaml", "/etc/passwd", "templates/../../outside.yaml"} {
+		if err := cw.WriteFile(ChartFile{Path: path, Content: "x"}); err == nil {
+			t.Errorf("WriteFile(%q) succeeded, want traversal error", path)
+		}
+	}
+}
+
+func TestWriteFile_RejectsSymlinkEscape(t *testing.T) {
+	chartDir := t.TempDir()
+	outsideDir := t.TempDir()
+
+	if err := os.Symlink(outsideDir, filepath.Join(chartDir, "escape")); err != nil {
+		t.Fatalf("Symlink: %v", err)
+	}
+
+	cw := ChartWriter{
+		Directory:  chartDir,
+		FileSystem: machinery.Filesystem{FS: afero.NewOsFs()},
+	}
+
+	if err := cw.WriteFile(ChartFile{Path: "escape/evil.yaml", Content: "x"}); err == nil {
+		t.Fatal("WriteFile through a symlink escaping Directory succeeded, want an error")
+	}
+
+	if _, err := os.Stat(filepath.Join(outsideDir, "evil.yaml")); !os.IsNotExist(err) {
+		t.Fatalf("file was written outside Directory through the symlink: %v", err)
+	}
+}
+
+func TestNewOverlayWriter_MergeSeededAcrossRuns(t *testing.T) {
+	chartDir := t.TempDir()
+
+	// The user's current on-disk chart: they changed "image" from what was
+	// last generated, and left "replicas" alone.
+	current := "replicas: 1\nimage: foo\n"
+	if err := os.MkdirAll(chartDir, 0o755); err != nil {
+		t.Fatalf("MkdirAll: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(chartDir, "values.yaml"), []byte(current), 0o644); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+
+	// seed mimics what a previous process's SnapshotFiles would have
+	// persisted: the chart as it was generated before the user's edit.
+	seed := []ChartFile{{Path: "values.yaml", Content: "replicas: 1\nimage: old\n"}}
+
+	cw, err := NewOverlayWriter(chartDir, afero.NewOsFs(), seed)
+	if err != nil {
+		t.Fatalf("NewOverlayWriter: %v", err)
+	}
+
+	// This run regenerates "replicas" but leaves "image" as it was
+	// generated before -- it should merge cleanly, keeping the user's edit.
+	err = cw.WriteFile(ChartFile{
+		Path:           "values.yaml",
+		Content:        "replicas: 2\nimage: old\n",
+		IfExistsAction: Merge,
+	})
+	if err != nil {
+		t.Fatalf("WriteFile (merge): %v", err)
+	}
+
+	got, err := os.ReadFile(filepath.Join(chartDir, "values.yaml"))
+	if err != nil {
+		t.Fatalf("reading merged file: %v", err)
+	}
+	want := "replicas: 2\nimage: foo\n"
+	if string(got) != want {
+		t.Fatalf("merged content = %q, want %q", got, want)
+	}
+}
+
+func TestNewOverlayWriter_MergeConflictLeavesFileUntouched(t *testing.T) {
+	chartDir := t.TempDir()
+
+	current := "replicas: 1\nimage: foo\n"
+	if err := os.MkdirAll(chartDir, 0o755); err != nil {
+		t.Fatalf("MkdirAll: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(chartDir, "values.yaml"), []byte(current), 0o644); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+
+	seed := []ChartFile{{Path: "values.yaml", Content: "replicas: 1\nimage: old\n"}}
+
+	cw, err := NewOverlayWriter(chartDir, afero.NewOsFs(), seed)
+	if err != nil {
+		t.Fatalf("NewOverlayWriter: %v", err)
+	}
+
+	// Both the user and this run changed "image", to different values --
+	// that's a genuine conflict, not a no-op regeneration.
+	err = cw.WriteFile(ChartFile{
+		Path:           "values.yaml",
+		Content:        "replicas: 1\nimage: new\n",
+		IfExistsAction: Merge,
+	})
+	var conflictErr *MergeConflictError
+	if !errors.As(err, &conflictErr) {
+		t.Fatalf("WriteFile (merge conflict) = %v, want a *MergeConflictError", err)
+	}
+
+	got, err := os.ReadFile(filepath.Join(chartDir, "values.yaml"))
+	if err != nil {
+		t.Fatalf("reading file after conflict: %v", err)
+	}
+	if string(got) != current {
+		t.Fatalf("file was modified despite conflict: got %q, want unchanged %q", got, current)
+	}
+}
+
+func TestWriteArchive_ProducesExpectedLayout(t *testing.T) {
+	dir := t.TempDir()
+	chartDir := filepath.Join(dir, "mychart")
+
+	cw := ChartWriter{
+		Directory:  chartDir,
+		FileSystem: machinery.Filesystem{FS: afero.NewOsFs()},
+	}
+
+	files := []ChartFile{
+		{Path: "templates/deployment.yaml", Content: "kind: Deployment"},
+		{Path: "Chart.yaml", Content: "name: mychart"},
+	}
+	if err := cw.WriteArchive(files); err != nil {
+		t.Fatalf("WriteArchive: %v", err)
+	}
+
+	entries := readTarGz(t, chartDir+".tgz")
+	want := map[string]string{
+		"mychart/Chart.yaml":                "name: mychart\n",
+		"mychart/templates/deployment.yaml": "kind: Deployment\n",
+	}
+	if len(entries) != len(want) {
+		t.Fatalf("archive has %d entries, want %d: %v", len(entries), len(want), entries)
+	}
+	for name, content := range want {
+		got, ok := entries[name]
+		if !ok {
+			t.Fatalf("archive missing entry %q, got %v", name, entries)
+		}
+		if got != content {
+			t.Errorf("entry %q = %q, want %q", name, got, content)
+		}
+	}
+}
+
+func TestWriteArchive_RejectsPathTraversal(t *testing.T) {
+	dir := t.TempDir()
+	chartDir := filepath.Join(dir, "mychart")
+
+	cw := ChartWriter{
+		Directory:  chartDir,
+		FileSystem: machinery.Filesystem{FS: afero.NewOsFs()},
+	}
+
+	files := []ChartFile{{Path: "../../../../tmp/evil.sh", Content: "#!/bin/sh\n"}}
+	if err := cw.WriteArchive(files); err == nil {
+		t.Fatal("WriteArchive with a path-traversing ChartFile succeeded, want an error")
+	}
+	if _, err := os.Stat(filepath.Join(dir, "tmp", "evil.sh")); !os.IsNotExist(err) {
+		t.Fatalf("archive entry escaped the chart directory on extraction: %v", err)
+	}
+}
+
+func TestPackageChart_RoundTripsWrittenFiles(t *testing.T) {
+	dir := t.TempDir()
+	chartDir := filepath.Join(dir, "mychart")
+
+	cw := ChartWriter{
+		Directory:  chartDir,
+		FileSystem: machinery.Filesystem{FS: afero.NewOsFs()},
+	}
+	files := []ChartFile{{Path: "Chart.yaml", Content: "name: mychart"}}
+	if err := cw.WriteFiles(files); err != nil {
+		t.Fatalf("WriteFiles: %v", err)
+	}
+
+	archivePath := filepath.Join(dir, "mychart-0.1.0.tgz")
+	if err := cw.PackageChart(archivePath); err != nil {
+		t.Fatalf("PackageChart: %v", err)
+	}
+
+	entries := readTarGz(t, archivePath)
+	if got, want := entries["mychart/Chart.yaml"], "name: mychart\n"; got != want {
+		t.Errorf("packaged Chart.yaml = %q, want %q", got, want)
+	}
+}
+
+// readTarGz reads a gzip-compressed tar archive from path and returns its
+// entries keyed by name.
+func readTarGz(t *testing.T, path string) map[string]string {
+	t.Helper()
+
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatalf("opening archive %s: %v", path, err)
+	}
+	defer f.Close()
+
+	gz, err := gzip.NewReader(f)
+	if err != nil {
+		t.Fatalf("gzip.NewReader: %v", err)
+	}
+	defer gz.Close()
+
+	entries := map[string]string{}
+	tr := tar.NewReader(gz)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("reading tar entry: %v", err)
+		}
+		content, err := io.ReadAll(tr)
+		if err != nil {
+			t.Fatalf("reading content for %s: %v", hdr.Name, err)
+		}
+		entries[hdr.Name] = string(content)
+	}
+	return entries
+}
+
+func TestNewChartWriter_OSBackend_WritesToRealDisk(t *testing.T) {
+	chartDir := filepath.Join(t.TempDir(), "mychart")
+
+	cw, err := NewChartWriter(chartDir, BackendOS)
+	if err != nil {
+		t.Fatalf("NewChartWriter: %v", err)
+	}
+
+	if err := cw.WriteFile(ChartFile{Path: "Chart.yaml", Content: "name: mychart"}); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+
+	got, err := os.ReadFile(filepath.Join(chartDir, "Chart.yaml"))
+	if err != nil {
+		t.Fatalf("reading written file from disk: %v", err)
+	}
+	if string(got) != "name: mychart\n" {
+		t.Fatalf("content = %q, want %q", got, "name: mychart\n")
+	}
+}
+
+func TestNewChartWriter_MemBackend_DoesNotTouchDisk(t *testing.T) {
+	chartDir := filepath.Join(t.TempDir(), "mychart")
+
+	cw, err := NewChartWriter(chartDir, BackendMem)
+	if err != nil {
+		t.Fatalf("NewChartWriter: %v", err)
+	}
+
+	if err := cw.WriteFile(ChartFile{Path: "Chart.yaml", Content: "name: mychart"}); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+
+	if _, err := os.Stat(filepath.Join(chartDir, "Chart.yaml")); !os.IsNotExist(err) {
+		t.Fatalf("mem backend wrote through to the real disk: %v", err)
+	}
+
+	exists, err := afero.Exists(cw.FileSystem.FS, filepath.Join(chartDir, "Chart.yaml"))
+	if err != nil {
+		t.Fatalf("afero.Exists: %v", err)
+	}
+	if !exists {
+		t.Fatal("file not found in the in-memory filesystem")
+	}
+}
+
+func TestNewChartWriter_ReadOnlyBackend_RejectsWrites(t *testing.T) {
+	base := afero.NewMemMapFs()
+	chartDir := filepath.Join(t.TempDir(), "mychart")
+
+	cw, err := NewChartWriter(chartDir, BackendReadOnly, WithBase(base))
+	if err != nil {
+		t.Fatalf("NewChartWriter: %v", err)
+	}
+
+	if err := cw.WriteFile(ChartFile{Path: "Chart.yaml", Content: "name: mychart"}); err == nil {
+		t.Fatal("WriteFile on a readonly-backed ChartWriter succeeded, want an error")
+	}
+}
+
+func TestNewChartWriter_UnknownBackend(t *testing.T) {
+	if _, err := NewChartWriter(t.TempDir(), "bogus"); err == nil {
+		t.Fatal("NewChartWriter with an unknown backend succeeded, want an error")
+	}
+}
+
+func TestServeHTTP_ServesIndexAndArchive(t *testing.T) {
+	chartDir := filepath.Join(t.TempDir(), "mychart")
+
+	cw, err := NewChartWriter(chartDir, BackendHTTP)
+	if err != nil {
+		t.Fatalf("NewChartWriter: %v", err)
+	}
+
+	if err := cw.WriteFiles([]ChartFile{{Path: "Chart.yaml", Content: "name: mychart"}}); err != nil {
+		t.Fatalf("WriteFiles: %v", err)
+	}
+
+	handler, err := cw.ServeHTTP()
+	if err != nil {
+		t.Fatalf("ServeHTTP: %v", err)
+	}
+
+	srv := httptest.NewServer(handler)
+	defer srv.Close()
+
+	resp, err := http.Get(srv.URL + "/index.yaml")
+	if err != nil {
+		t.Fatalf("GET /index.yaml: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("GET /index.yaml status = %d, want %d", resp.StatusCode, http.StatusOK)
+	}
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("reading index.yaml response: %v", err)
+	}
+	if !strings.Contains(string(body), "name: mychart") {
+		t.Fatalf("index.yaml = %q, want it to reference chart %q", body, "mychart")
+	}
+
+	resp, err = http.Get(srv.URL + "/mychart.tgz")
+	if err != nil {
+		t.Fatalf("GET /mychart.tgz: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("GET /mychart.tgz status = %d, want %d", resp.StatusCode, http.StatusOK)
+	}
+}
+
+func TestWriteFiles_WritesEveryFileAcrossTheWorkerPool(t *testing.T) {
+	cw := ChartWriter{
+		Directory:  t.TempDir(),
+		FileSystem: machinery.Filesystem{FS: afero.NewMemMapFs()},
+	}
+
+	const count = 50
+	files := make([]ChartFile, count)
+	for i := range files {
+		files[i] = ChartFile{Path: fmt.Sprintf("templates/file%02d.yaml", i), Content: fmt.Sprintf("index: %d", i)}
+	}
+
+	if err := cw.WriteFiles(files); err != nil {
+		t.Fatalf("WriteFiles: %v", err)
+	}
+
+	for i, f := range files {
+		got, err := afero.ReadFile(cw.rootedFS(), f.Path)
+		if err != nil {
+			t.Fatalf("reading %s back: %v", f.Path, err)
+		}
+		want := fmt.Sprintf("index: %d\n", i)
+		if string(got) != want {
+			t.Errorf("content for %s = %q, want %q", f.Path, got, want)
+		}
+	}
+}
+
+func TestWriteFiles_AggregatesErrorsAcrossFiles(t *testing.T) {
+	cw := ChartWriter{
+		Directory:  t.TempDir(),
+		FileSystem: machinery.Filesystem{FS: afero.NewMemMapFs()},
+	}
+
+	files := []ChartFile{
+		{Path: "Chart.yaml", Content: "name: mychart"},
+		{Path: "../outside-one.yaml", Content: "x"},
+		{Path: "../outside-two.yaml", Content: "x"},
+	}
+
+	plans, err := cw.writeFiles(files, false)
+	if err == nil {
+		t.Fatal("WriteFiles with invalid paths succeeded, want an aggregated error")
+	}
+
+	joined, ok := err.(interface{ Unwrap() []error })
+	if !ok {
+		t.Fatalf("error %v does not expose Unwrap() []error from errors.Join", err)
+	}
+	if got := len(joined.Unwrap()); got != 2 {
+		t.Fatalf("errors.Join aggregated %d errors, want 2: %v", got, err)
+	}
+
+	var gotPaths []string
+	for _, p := range plans {
+		gotPaths = append(gotPaths, p.Path)
+	}
+	for _, p := range files {
+		found := false
+		for _, g := range gotPaths {
+			if g == p.Path {
+				found = true
+			}
+		}
+		if !found {
+			t.Errorf("plans missing entry for %s: %v", p.Path, plans)
+		}
+	}
+
+	if ok, err := afero.Exists(cw.rootedFS(), "Chart.yaml"); err != nil || !ok {
+		t.Errorf("valid file in the same batch was not written: exists=%v err=%v", ok, err)
+	}
+}
+
+func TestWriteFiles_AggregatesMergeConflictsAcrossFiles(t *testing.T) {
+	chartDir := t.TempDir()
+	for _, name := range []string{"values.yaml", "config.yaml"} {
+		if err := os.WriteFile(filepath.Join(chartDir, name), []byte("key: current\n"), 0o644); err != nil {
+			t.Fatalf("seeding %s: %v", name, err)
+		}
+	}
+
+	seed := []ChartFile{
+		{Path: "values.yaml", Content: "key: old\n"},
+		{Path: "config.yaml", Content: "key: old\n"},
+	}
+	cw, err := NewOverlayWriter(chartDir, afero.NewOsFs(), seed)
+	if err != nil {
+		t.Fatalf("NewOverlayWriter: %v", err)
+	}
+
+	files := []ChartFile{
+		{Path: "values.yaml", Content: "key: new\n", IfExistsAction: Merge},
+		{Path: "config.yaml", Content: "key: new\n", IfExistsAction: Merge},
+	}
+	err = cw.WriteFiles(files)
+
+	var conflictErr *MergeConflictError
+	if !errors.As(err, &conflictErr) {
+		t.Fatalf("WriteFiles = %v, want a *MergeConflictError", err)
+	}
+	if len(conflictErr.Paths) != 2 {
+		t.Fatalf("MergeConflictError.Paths = %v, want both conflicting files", conflictErr.Paths)
+	}
+}
+
+func TestPlanFiles_DoesNotWriteAndReportsEachAction(t *testing.T) {
+	chartDir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(chartDir, "unchanged.yaml"), []byte("same\n"), 0o644); err != nil {
+		t.Fatalf("seeding unchanged.yaml: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(chartDir, "overwrite.yaml"), []byte("old\n"), 0o644); err != nil {
+		t.Fatalf("seeding overwrite.yaml: %v", err)
+	}
+
+	cw := ChartWriter{
+		Directory:  chartDir,
+		FileSystem: machinery.Filesystem{FS: afero.NewOsFs()},
+	}
+
+	files := []ChartFile{
+		{Path: "unchanged.yaml", Content: "same"},
+		{Path: "overwrite.yaml", Content: "new"},
+		{Path: "create.yaml", Content: "fresh"},
+	}
+	plans, err := cw.PlanFiles(files)
+	if err != nil {
+		t.Fatalf("PlanFiles: %v", err)
+	}
+
+	want := map[string]FileAction{
+		"unchanged.yaml": ActionUnchanged,
+		"overwrite.yaml": ActionOverwrite,
+		"create.yaml":    ActionCreate,
+	}
+	for _, p := range plans {
+		if got, ok := want[p.Path]; !ok || got != p.Action {
+			t.Errorf("plan for %s = %s, want %s", p.Path, p.Action, want[p.Path])
+		}
+	}
+
+	if _, err := os.Stat(filepath.Join(chartDir, "create.yaml")); !os.IsNotExist(err) {
+		t.Fatalf("PlanFiles wrote create.yaml to disk, want a dry run: %v", err)
+	}
+	got, err := os.ReadFile(filepath.Join(chartDir, "overwrite.yaml"))
+	if err != nil {
+		t.Fatalf("reading overwrite.yaml: %v", err)
+	}
+	if string(got) != "old\n" {
+		t.Fatalf("PlanFiles modified overwrite.yaml on disk: got %q, want unchanged %q", got, "old\n")
+	}
+}